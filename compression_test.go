@@ -0,0 +1,92 @@
+package framed
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.CompressionWriter = FlateCompressionWriter
+	r := NewReader(&buf)
+	r.DecompressionReader = FlateDecompressionReader
+
+	payload := bytes.Repeat([]byte("compressible payload "), 200)
+	if _, err := w.Write(payload); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := r.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %d bytes, want %d bytes", len(got), len(payload))
+	}
+}
+
+func TestCompressionFallbackWhenIncompressible(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.CompressionWriter = FlateCompressionWriter
+	r := NewReader(&buf)
+	r.DecompressionReader = FlateDecompressionReader
+
+	// Random-looking, already-compressed-like data that flate cannot shrink.
+	payload := make([]byte, 256)
+	for i := range payload {
+		payload[i] = byte(i*97 + 53)
+	}
+	if _, err := w.Write(payload); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := r.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("fallback payload mismatch: got %d bytes, want %d bytes", len(got), len(payload))
+	}
+}
+
+// zipBombDecompressionReader is a DecompressionReader factory that decompresses to far more
+// bytes than it received, simulating a decompression bomb.
+func zipBombDecompressionReader(r io.Reader) io.ReadCloser {
+	return io.NopCloser(zeroReader{})
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestReadFrameRejectsDecompressionBomb(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	// Write a small compressed-looking frame directly: flag byte with the
+	// compressed bit set, plus a tiny payload. The DecompressionReader below
+	// expands this into an effectively unbounded stream.
+	frameBody := append([]byte{flagCompressed}, []byte("x")...)
+	if _, err := w.WritePieces(frameBody); err != nil {
+		t.Fatalf("WritePieces: %v", err)
+	}
+
+	r := NewReader(&buf)
+	r.DecompressionReader = zipBombDecompressionReader
+	r.MaxFrameLength = 1024
+
+	_, err := r.ReadFrame()
+	if err == nil {
+		t.Fatal("expected ReadFrame to reject an oversized decompressed payload, got nil error")
+	}
+	if _, ok := err.(*ErrDecompressedFrameTooLarge); !ok {
+		t.Fatalf("expected *ErrDecompressedFrameTooLarge, got %T: %v", err, err)
+	}
+}
@@ -12,9 +12,14 @@ is 65535.
 package framed
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"sync"
 )
 
@@ -25,26 +30,237 @@ const (
 	// FrameHeaderLength is the size of the frame header in bytes
 	FrameHeaderLength = FrameHeaderBits / 8
 
-	// MaxFrameLength is the maximum possible size of a frame (not including the
-	// length prefix)
+	// MaxFrameLength is the maximum possible size of a frame using the
+	// default HeaderUint16LE format (not including the length prefix)
 	MaxFrameLength = 1<<FrameHeaderBits - 1
 
-	tooLongError = "Attempted to write frame of length %d which is longer than maximum allowed length of %d"
+	tooLongWriteError = "Attempted to write frame of length %d which is longer than maximum allowed length of %d"
+	tooLongReadError  = "Received frame of length %d which is longer than maximum allowed length of %d"
 )
 
 var endianness = binary.LittleEndian
 
+// ErrNoFrameAdvance is returned by Read when it is called without a prior,
+// unexhausted call to NextFrame having declared how much data is available
+// to read.
+var ErrNoFrameAdvance = errors.New("framed: Read called without a preceding NextFrame")
+
+// ErrMalformedHeader is returned by readHeader when a frame's length header
+// decodes to a value that doesn't fit in an int on this platform (e.g. a
+// HeaderVarint whose encoded value sets bit 63). Without this check, that
+// value would convert to a negative int and flow straight into a slice
+// length, panicking instead of failing cleanly.
+var ErrMalformedHeader = errors.New("framed: frame header decoded to an invalid length")
+
+// HeaderFormat identifies the on-wire encoding of a frame's length prefix.
+type HeaderFormat int
+
+const (
+	// HeaderUint16LE encodes the length prefix as an unsigned 16 bit int in
+	// little-endian byte order. This is the default, wire-compatible with the
+	// original framed format, and caps frames at 65535 bytes.
+	HeaderUint16LE HeaderFormat = iota
+
+	// HeaderUint32BE encodes the length prefix as an unsigned 32 bit int in
+	// big-endian byte order, as used by Kubernetes apimachinery's framer.
+	HeaderUint32BE
+
+	// HeaderVarint encodes the length prefix as a Go encoding/binary unsigned
+	// varint, which is compact for small frames but has no fixed theoretical
+	// maximum.
+	HeaderVarint
+)
+
+// defaultMaxFrameLength returns the default maximum frame length applied
+// when a Reader/Writer doesn't set MaxFrameLength explicitly. HeaderUint32BE
+// and HeaderVarint can encode frames far larger than this, but defaulting to
+// their theoretical maximum would let a single small header commit a peer to
+// allocating up to 4GiB; callers that need bigger frames opt in explicitly
+// via MaxFrameLength.
+func defaultMaxFrameLength(format HeaderFormat) int {
+	return MaxFrameLength
+}
+
+// flagCompressed is set in a frame's flag byte when CompressionWriter and
+// DecompressionReader are in use and the frame's payload is compressed. It
+// is the high bit of the flag byte so the remaining bits stay free for
+// future use.
+const flagCompressed byte = 0x80
+
+// FlateCompressionWriter is a ready-made CompressionWriter backed by
+// compress/flate at the default compression level. Each frame gets a fresh
+// flate.Writer with no dictionary carried over from the previous frame,
+// mirroring the "no context takeover" compression mode from RFC 7692 that
+// gorilla/websocket ships for per-message compression.
+func FlateCompressionWriter(w io.Writer) io.WriteCloser {
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return fw
+}
+
+// FlateDecompressionReader is a ready-made DecompressionReader backed by
+// compress/flate, pairing with FlateCompressionWriter.
+func FlateDecompressionReader(r io.Reader) io.ReadCloser {
+	return flate.NewReader(r)
+}
+
+// ErrFrameTooLarge is returned when an incoming frame's declared length, or
+// an outgoing frame's length, exceeds the effective MaxFrameLength, so
+// callers can distinguish it from ordinary I/O errors. Reading distinguishes whether this came from
+// rejecting an oversized incoming frame or an oversized outgoing one, since
+// the two need different wording.
+type ErrFrameTooLarge struct {
+	Length  int
+	Max     int
+	Reading bool
+}
+
+func (e *ErrFrameTooLarge) Error() string {
+	if e.Reading {
+		return fmt.Sprintf(tooLongReadError, e.Length, e.Max)
+	}
+	return fmt.Sprintf(tooLongWriteError, e.Length, e.Max)
+}
+
+// ErrDecompressedFrameTooLarge is returned when a compressed frame's
+// decompressed payload exceeds the effective MaxFrameLength, so a peer can't
+// use a small compressed frame to force an unbounded allocation.
+type ErrDecompressedFrameTooLarge struct {
+	Max int
+}
+
+func (e *ErrDecompressedFrameTooLarge) Error() string {
+	return fmt.Sprintf("framed: decompressed frame exceeds maximum allowed length of %d", e.Max)
+}
+
+// headerBytes encodes length as a standalone length-prefix in the given
+// format, for callers (like WritePieces' coalesced write path) that need
+// the header bytes rather than having them written directly.
+func headerBytes(format HeaderFormat, length int) []byte {
+	switch format {
+	case HeaderUint32BE:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(length))
+		return b
+	case HeaderVarint:
+		b := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(b, uint64(length))
+		return b[:n]
+	default:
+		b := make([]byte, 2)
+		endianness.PutUint16(b, uint16(length))
+		return b
+	}
+}
+
+// writeHeader writes a length prefix in the given format.
+func writeHeader(w io.Writer, format HeaderFormat, length int) error {
+	_, err := w.Write(headerBytes(format, length))
+	return err
+}
+
+// readHeader reads a length prefix in the given format.
+func readHeader(r io.Reader, format HeaderFormat) (int, error) {
+	switch format {
+	case HeaderUint32BE:
+		var nb uint32
+		if err := binary.Read(r, binary.BigEndian, &nb); err != nil {
+			return 0, err
+		}
+		if uint64(nb) > math.MaxInt {
+			return 0, ErrMalformedHeader
+		}
+		return int(nb), nil
+	case HeaderVarint:
+		nb, err := readUvarint(r)
+		if err != nil {
+			return 0, err
+		}
+		if nb > math.MaxInt {
+			return 0, ErrMalformedHeader
+		}
+		return int(nb), nil
+	default:
+		var nb uint16
+		if err := binary.Read(r, endianness, &nb); err != nil {
+			return 0, err
+		}
+		return int(nb), nil
+	}
+}
+
+// readUvarint decodes a uvarint one byte at a time so that it never reads
+// past the header into the frame's payload, unlike binary.ReadUvarint backed
+// by a buffering io.ByteReader.
+func readUvarint(r io.Reader) (uint64, error) {
+	var x uint64
+	var s uint
+	var b [1]byte
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		if b[0] < 0x80 {
+			return x | uint64(b[0])<<s, nil
+		}
+		x |= uint64(b[0]&0x7f) << s
+		s += 7
+	}
+	return 0, errors.New("framed: varint header overflows uint64")
+}
+
 /*
 A Reader enhances an io.ReadCloser to read data in contiguous frames. It
 implements the io.Reader interface, but unlike typical io.Readers it only
 returns whole frames.
 
 A Reader also supports the ability to read frames using dynamically allocated
-buffers via the ReadFrame method.
+buffers via the ReadFrame method, or to stream a single frame's payload across
+multiple Read calls via NextFrame.
 */
 type Reader struct {
 	Stream io.Reader // the raw underlying connection
 	mutex  sync.Mutex
+
+	// HeaderFormat controls how this Reader decodes the length prefix. The
+	// zero value is HeaderUint16LE, preserving wire compatibility.
+	HeaderFormat HeaderFormat
+
+	// MaxFrameLength bounds the largest frame this Reader will accept. If
+	// zero, it defaults to the package-level MaxFrameLength (65535) for every
+	// HeaderFormat.
+	MaxFrameLength int
+
+	// AutoDiscard controls what happens when NextFrame is called while a
+	// previous frame obtained from NextFrame still has undrained bytes. If
+	// true, the remainder of the current frame is discarded automatically.
+	// If false, NextFrame returns an error instead.
+	AutoDiscard bool
+
+	// DecompressionReader, if set, causes Read and ReadFrame to treat every
+	// frame's first byte as a compression flag and transparently decompress
+	// frames whose flag marks them as compressed. It must agree with the
+	// corresponding Writer's CompressionWriter setting, since setting it
+	// changes the wire format by adding that flag byte. NextFrame/streaming
+	// reads do not support decompression.
+	DecompressionReader func(io.Reader) io.ReadCloser
+
+	// BufferPool, if set, is drawn from by ReadFrame to obtain the buffer
+	// backing the returned frame instead of always allocating a new one.
+	// Buffers obtained this way should be returned via PutFrame once the
+	// caller is done with them.
+	BufferPool *sync.Pool
+
+	streamingMode bool // whether NextFrame has ever been called on this Reader
+	remaining     int  // bytes left to read in the frame started by NextFrame
+	streaming     bool // whether a frame started by NextFrame is pending (cleared once Read reports io.EOF for it)
+}
+
+// maxLen returns the effective maximum frame length for this Reader.
+func (framed *Reader) maxLen() int {
+	if framed.MaxFrameLength > 0 {
+		return framed.MaxFrameLength
+	}
+	return defaultMaxFrameLength(framed.HeaderFormat)
 }
 
 /*
@@ -59,6 +275,32 @@ stream as a single frame.
 type Writer struct {
 	Stream io.Writer // the raw underlying connection
 	mutex  sync.Mutex
+
+	// HeaderFormat controls how this Writer encodes the length prefix. The
+	// zero value is HeaderUint16LE, preserving wire compatibility.
+	HeaderFormat HeaderFormat
+
+	// MaxFrameLength bounds the largest frame this Writer will emit. If
+	// zero, it defaults to the package-level MaxFrameLength (65535) for every
+	// HeaderFormat.
+	MaxFrameLength int
+
+	// CompressionWriter, if set, causes Write and WritePieces to pipe the
+	// payload through the returned io.WriteCloser, buffer the result, and
+	// emit a single frame prefixed with a flag byte marking whether the
+	// payload ended up compressed. MaxFrameLength is enforced against the
+	// on-wire (possibly compressed) size. If compression would make the
+	// frame larger, or would push it over MaxFrameLength, the uncompressed
+	// payload is sent instead.
+	CompressionWriter func(io.Writer) io.WriteCloser
+}
+
+// maxLen returns the effective maximum frame length for this Writer.
+func (framed *Writer) maxLen() int {
+	if framed.MaxFrameLength > 0 {
+		return framed.MaxFrameLength
+	}
+	return defaultMaxFrameLength(framed.HeaderFormat)
 }
 
 /*
@@ -79,6 +321,18 @@ func NewWriter(w io.Writer) *Writer {
 	return &Writer{Stream: w}
 }
 
+// NewReaderWithFormat creates a Reader that decodes length prefixes using
+// the given HeaderFormat instead of the default HeaderUint16LE.
+func NewReaderWithFormat(r io.Reader, format HeaderFormat) *Reader {
+	return &Reader{Stream: r, HeaderFormat: format}
+}
+
+// NewWriterWithFormat creates a Writer that encodes length prefixes using
+// the given HeaderFormat instead of the default HeaderUint16LE.
+func NewWriterWithFormat(w io.Writer, format HeaderFormat) *Writer {
+	return &Writer{Stream: w, HeaderFormat: format}
+}
+
 func NewReadWriteCloser(rwc io.ReadWriteCloser) *ReadWriteCloser {
 	return &ReadWriteCloser{Reader{Stream: rwc}, Writer{Stream: rwc}, rwc}
 }
@@ -92,40 +346,256 @@ func (framed *Reader) Read(buffer []byte) (n int, err error) {
 	framed.mutex.Lock()
 	defer framed.mutex.Unlock()
 
-	var nb uint16
-	innererr = binary.Read(framed.Stream, endianness, &nb)
-	if innererr != nil {
-		return
+	if framed.streamingMode {
+		return framed.streamRead(buffer)
 	}
 
-	innern = int(nb)
+	l, err := readHeader(framed.Stream, framed.HeaderFormat)
+	if err != nil {
+		return 0, err
+	}
 
-	bufferSize := len(buffer)
-	if innern > bufferSize {
-		return 0, fmt.Errorf("Buffer of size %d is too small to hold frame of size %d", bufferSize, n)
+	if max := framed.maxLen(); l > max {
+		return 0, &ErrFrameTooLarge{Length: l, Max: max, Reading: true}
 	}
 
-	// Read into buffer
-	innern, innererr = io.ReadFull(framed.Stream, buffer[:innern])
+	if framed.DecompressionReader == nil {
+		n = l
+		bufferSize := len(buffer)
+		if n > bufferSize {
+			return 0, fmt.Errorf("Buffer of size %d is too small to hold frame of size %d", bufferSize, n)
+		}
+
+		// Read into buffer
+		n, err = io.ReadFull(framed.Stream, buffer[:n])
+		return
+	}
+
+	payload, err := framed.readCompressedPayload(l)
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) > len(buffer) {
+		return 0, fmt.Errorf("Buffer of size %d is too small to hold frame of size %d", len(buffer), len(payload))
+	}
+	n = copy(buffer, payload)
 	return
 }
 
 // ReadFrame reads the next frame, using a new buffer sized to hold the frame.
+// When BufferPool is set and yields a buffer large enough, that buffer is
+// used instead.
+//
+// If a frame started by NextFrame hasn't been fully drained via Read yet,
+// ReadFrame discards its remainder (if AutoDiscard is true) or returns an
+// error (if it is false) before reading a new header, so it never
+// misinterprets the tail of that frame's payload as a fresh header.
 func (framed *Reader) ReadFrame() (frame []byte, err error) {
 	framed.mutex.Lock()
 	defer framed.mutex.Unlock()
 
-	var nb uint16
-	innererr = binary.Read(framed.Stream, endianness, &nb)
-	if innererr != nil {
+	if err = framed.drainPendingFrame("ReadFrame"); err != nil {
+		return nil, err
+	}
+
+	l, err := readHeader(framed.Stream, framed.HeaderFormat)
+	if err != nil {
 		return
 	}
 
-	l := int(nb)
-	innerframe = make([]byte, l)
+	if max := framed.maxLen(); l > max {
+		return nil, &ErrFrameTooLarge{Length: l, Max: max, Reading: true}
+	}
+
+	if framed.DecompressionReader == nil {
+		frame = framed.getBuffer(l)
+		// Read into buffer
+		_, err = io.ReadFull(framed.Stream, frame)
+		return
+	}
+
+	return framed.readCompressedPayload(l)
+}
+
+// ReadFrameInto reads the next frame into buf, growing and returning a new
+// slice only if buf isn't large enough to hold it. This lets callers reuse a
+// buffer across calls instead of allocating a fresh one for every frame.
+// When DecompressionReader is set, buf is not used: the decompressed frame
+// is always returned in a newly allocated slice.
+//
+// Like ReadFrame, it first discards (or errors on) any undrained remainder
+// of a frame started by NextFrame; see ReadFrame's doc comment.
+func (framed *Reader) ReadFrameInto(buf []byte) (frame []byte, err error) {
+	framed.mutex.Lock()
+	defer framed.mutex.Unlock()
+
+	if err = framed.drainPendingFrame("ReadFrameInto"); err != nil {
+		return nil, err
+	}
+
+	l, err := readHeader(framed.Stream, framed.HeaderFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	if max := framed.maxLen(); l > max {
+		return nil, &ErrFrameTooLarge{Length: l, Max: max, Reading: true}
+	}
+
+	if framed.DecompressionReader != nil {
+		return framed.readCompressedPayload(l)
+	}
+
+	if cap(buf) < l {
+		buf = make([]byte, l)
+	} else {
+		buf = buf[:l]
+	}
+
+	_, err = io.ReadFull(framed.Stream, buf)
+	return buf, err
+}
+
+// getBuffer returns an l-byte slice, drawn from BufferPool when set and a
+// suitably-sized buffer is available.
+func (framed *Reader) getBuffer(l int) []byte {
+	if framed.BufferPool != nil {
+		if v := framed.BufferPool.Get(); v != nil {
+			if buf := v.([]byte); cap(buf) >= l {
+				return buf[:l]
+			}
+		}
+	}
+	return make([]byte, l)
+}
+
+// PutFrame returns a frame buffer obtained from ReadFrame to BufferPool so
+// it can be reused by a later ReadFrame call. It is a no-op if BufferPool is
+// nil.
+func (framed *Reader) PutFrame(frame []byte) {
+	if framed.BufferPool != nil {
+		framed.BufferPool.Put(frame[:0:cap(frame)])
+	}
+}
 
-	// Read into buffer
-	_, innererr = io.ReadFull(framed.Stream, innerframe)
+// readCompressedPayload reads an l-byte frame whose first byte is a
+// compression flag, transparently decompressing it if the flag is set. It
+// must be called with framed.mutex held and framed.DecompressionReader set.
+func (framed *Reader) readCompressedPayload(l int) (payload []byte, err error) {
+	raw := make([]byte, l)
+	if _, err = io.ReadFull(framed.Stream, raw); err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("framed: frame missing compression flag byte")
+	}
+
+	flag, body := raw[0], raw[1:]
+	if flag&flagCompressed == 0 {
+		return body, nil
+	}
+
+	dr := framed.DecompressionReader(bytes.NewReader(body))
+	defer dr.Close()
+
+	// A small compressed frame can decompress to an arbitrarily large
+	// payload. Bound the decompressed size to the same effective limit
+	// applied to on-wire frames so a malicious peer can't use compression to
+	// force an unbounded allocation.
+	max := framed.maxLen()
+	payload, err = io.ReadAll(io.LimitReader(dr, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > max {
+		return nil, &ErrDecompressedFrameTooLarge{Max: max}
+	}
+	return payload, nil
+}
+
+// drainPendingFrame discards any bytes left over from a frame previously
+// started via NextFrame, so that NextFrame/ReadFrame/ReadFrameInto can
+// safely read a new header without desyncing on the old frame's trailing
+// payload bytes. It must be called with framed.mutex held. If AutoDiscard
+// is false, it returns an error instead of discarding.
+func (framed *Reader) drainPendingFrame(caller string) error {
+	if !framed.streaming || framed.remaining == 0 {
+		return nil
+	}
+	if !framed.AutoDiscard {
+		return fmt.Errorf("%s called with %d bytes remaining in a frame started by NextFrame", caller, framed.remaining)
+	}
+	if _, err := io.CopyN(io.Discard, framed.Stream, int64(framed.remaining)); err != nil {
+		return err
+	}
+	framed.remaining = 0
+	return nil
+}
+
+/*
+NextFrame reads just the frame's length header and reports the declared
+payload length without reading any of the payload itself. Subsequent calls
+to Read drain up to length bytes from the underlying stream, returning
+io.EOF once the frame's payload has been fully consumed. This lets callers
+stream a frame's payload (e.g. via io.Copy) without allocating a buffer
+large enough to hold it.
+
+If the previously returned frame's payload has not been fully drained,
+NextFrame either discards the remainder automatically (if AutoDiscard is
+true) or returns an error without reading a new header (if it is false).
+
+Once NextFrame has been called on a Reader, Read is permanently switched
+into streaming mode: every subsequent Read drains the frame most recently
+declared by NextFrame and returns ErrNoFrameAdvance if no such frame is
+pending, even after a previous streamed frame has been fully drained. A
+Reader that has called NextFrame should keep using NextFrame/Read together
+rather than falling back to the legacy standalone Read or ReadFrame.
+*/
+func (framed *Reader) NextFrame() (length int, err error) {
+	framed.mutex.Lock()
+	defer framed.mutex.Unlock()
+
+	if err = framed.drainPendingFrame("NextFrame"); err != nil {
+		return 0, err
+	}
+
+	length, err = readHeader(framed.Stream, framed.HeaderFormat)
+	if err != nil {
+		framed.streaming = false
+		return 0, err
+	}
+
+	if max := framed.maxLen(); length > max {
+		framed.streaming = false
+		return 0, &ErrFrameTooLarge{Length: length, Max: max, Reading: true}
+	}
+
+	framed.remaining = length
+	framed.streaming = true
+	framed.streamingMode = true
+	return
+}
+
+/*
+streamRead implements Read for the streaming mode entered via NextFrame. It
+must be called with framed.mutex held.
+*/
+func (framed *Reader) streamRead(buffer []byte) (n int, err error) {
+	if !framed.streaming {
+		return 0, ErrNoFrameAdvance
+	}
+	if framed.remaining == 0 {
+		framed.streaming = false
+		return 0, io.EOF
+	}
+
+	toRead := len(buffer)
+	if toRead > framed.remaining {
+		toRead = framed.remaining
+	}
+
+	n, err = framed.Stream.Read(buffer[:toRead])
+	framed.remaining -= n
 	return
 }
 
@@ -137,55 +607,189 @@ func (framed *Writer) Write(frame []byte) (n int, err error) {
 	framed.mutex.Lock()
 	defer framed.mutex.Unlock()
 
-	innern = len(frame)
-	if innern > MaxFrameLength {
-		return 0, fmt.Errorf(tooLongError, n, MaxFrameLength)
+	n = len(frame)
+
+	payload, compressed, err := framed.compress(frame)
+	if err != nil {
+		return 0, err
+	}
+
+	total := len(payload)
+	if framed.CompressionWriter != nil {
+		total++ // flag byte
+	}
+	if max := framed.maxLen(); total > max {
+		return 0, &ErrFrameTooLarge{Length: total, Max: max}
 	}
 
 	// Write the length header
-	if innererr = binary.Write(framed.Stream, endianness, uint16(innern)); innererr != nil {
+	if err = writeHeader(framed.Stream, framed.HeaderFormat, total); err != nil {
 		return
 	}
 
+	if framed.CompressionWriter != nil {
+		if err = framed.writeFlag(compressed); err != nil {
+			return
+		}
+	}
+
 	// Write the data
 	var written int
-	if written, innererr = framed.Stream.Write(frame); innererr != nil {
+	if written, err = framed.Stream.Write(payload); err != nil {
 		return
 	}
-	if written != innern {
-		innererr = fmt.Errorf("%d bytes written, expected to write %d", written, n)
+	if written != len(payload) {
+		err = fmt.Errorf("%d bytes written, expected to write %d", written, len(payload))
 	}
 	return
 }
 
+// compress pipes frame through CompressionWriter, if set, and returns the
+// compressed bytes along with whether compression actually helped. If
+// CompressionWriter is nil, or compression didn't shrink the payload, it
+// returns frame unchanged with compressed=false so the uncompressed payload
+// is sent instead.
+func (framed *Writer) compress(frame []byte) (payload []byte, compressed bool, err error) {
+	if framed.CompressionWriter == nil {
+		return frame, false, nil
+	}
+
+	var buf bytes.Buffer
+	cw := framed.CompressionWriter(&buf)
+	if _, err = cw.Write(frame); err != nil {
+		return nil, false, err
+	}
+	if err = cw.Close(); err != nil {
+		return nil, false, err
+	}
+
+	if buf.Len() < len(frame) {
+		return buf.Bytes(), true, nil
+	}
+	return frame, false, nil
+}
+
+// writeFlag writes the one-byte compression flag that precedes a frame's
+// payload whenever CompressionWriter is set.
+func (framed *Writer) writeFlag(compressed bool) error {
+	flag := byte(0)
+	if compressed {
+		flag = flagCompressed
+	}
+	_, err := framed.Stream.Write([]byte{flag})
+	return err
+}
+
+// writeCoalesced writes the length header and all pieces to tcp as a single
+// net.Buffers write, letting the runtime issue one writev syscall instead of
+// one Write call per piece.
+func (framed *Writer) writeCoalesced(tcp *net.TCPConn, n int, pieces [][]byte) error {
+	header := headerBytes(framed.HeaderFormat, n)
+	bufs := make(net.Buffers, 0, len(pieces)+1)
+	bufs = append(bufs, header)
+	bufs = append(bufs, pieces...)
+
+	expected := int64(len(header) + n)
+	written, err := bufs.WriteTo(tcp)
+	if err != nil {
+		return err
+	}
+	if written != expected {
+		return fmt.Errorf("%d bytes written, expected to write %d", written, expected)
+	}
+	return nil
+}
+
 func (framed *Writer) WritePieces(pieces ...[]byte) (n int, err error) {
 	framed.mutex.Lock()
 	defer framed.mutex.Unlock()
 
 	for _, piece := range pieces {
-		innern = innern + len(piece)
+		n = n + len(piece)
+	}
+
+	if framed.CompressionWriter == nil {
+		if max := framed.maxLen(); n > max {
+			return 0, &ErrFrameTooLarge{Length: n, Max: max}
+		}
+
+		if tcp, ok := framed.Stream.(*net.TCPConn); ok {
+			err = framed.writeCoalesced(tcp, n, pieces)
+			return
+		}
+
+		// Write the length header
+		if err = writeHeader(framed.Stream, framed.HeaderFormat, n); err != nil {
+			return
+		}
+
+		// Write the data
+		var written int
+		for _, piece := range pieces {
+			var nw int
+			if nw, err = framed.Stream.Write(piece); err != nil {
+				return
+			}
+			written = written + nw
+		}
+		if written != n {
+			err = fmt.Errorf("%d bytes written, expected to write %d", written, n)
+		}
+		return
+	}
+
+	var buf bytes.Buffer
+	cw := framed.CompressionWriter(&buf)
+	for _, piece := range pieces {
+		if _, err = cw.Write(piece); err != nil {
+			return 0, err
+		}
+	}
+	if err = cw.Close(); err != nil {
+		return 0, err
 	}
 
-	if n > MaxFrameLength {
-		return 0, fmt.Errorf(tooLongError, n, MaxFrameLength)
+	payload := []byte(nil)
+	compressed := buf.Len() < n
+	if compressed {
+		payload = buf.Bytes()
 	}
 
-	// Write the length header
-	if innererr = binary.Write(framed.Stream, endianness, uint16(n)); innererr != nil {
+	total := len(payload) + 1
+	if !compressed {
+		total = n + 1
+	}
+	if max := framed.maxLen(); total > max {
+		return 0, &ErrFrameTooLarge{Length: total, Max: max}
+	}
+
+	if err = writeHeader(framed.Stream, framed.HeaderFormat, total); err != nil {
+		return
+	}
+	if err = framed.writeFlag(compressed); err != nil {
 		return
 	}
 
-	// Write the data
 	var written int
+	if compressed {
+		if written, err = framed.Stream.Write(payload); err != nil {
+			return
+		}
+		if written != len(payload) {
+			err = fmt.Errorf("%d bytes written, expected to write %d", written, len(payload))
+		}
+		return
+	}
+
 	for _, piece := range pieces {
 		var nw int
-		if nw, innererr = framed.Stream.Write(piece); innererr != nil {
+		if nw, err = framed.Stream.Write(piece); err != nil {
 			return
 		}
 		written = written + nw
 	}
 	if written != n {
-		innererr = fmt.Errorf("%d bytes written, expected to write %d", written, n)
+		err = fmt.Errorf("%d bytes written, expected to write %d", written, n)
 	}
 	return
 }
@@ -0,0 +1,126 @@
+package framed
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// BenchmarkReadFrame shows the per-call allocation of the unpooled path.
+func BenchmarkReadFrame(b *testing.B) {
+	frame := make([]byte, 4096)
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	r := NewReader(&buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(frame); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := r.ReadFrame(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadFramePooled shows the allocation reduction from returning
+// buffers to a BufferPool between calls.
+func BenchmarkReadFramePooled(b *testing.B) {
+	frame := make([]byte, 4096)
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	r := NewReader(&buf)
+	r.BufferPool = &sync.Pool{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(frame); err != nil {
+			b.Fatal(err)
+		}
+		got, err := r.ReadFrame()
+		if err != nil {
+			b.Fatal(err)
+		}
+		r.PutFrame(got)
+	}
+}
+
+// BenchmarkReadFrameInto shows the allocation reduction from reusing a
+// single caller-owned buffer across calls.
+func BenchmarkReadFrameInto(b *testing.B) {
+	frame := make([]byte, 4096)
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	r := NewReader(&buf)
+	into := make([]byte, 0, 4096)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(frame); err != nil {
+			b.Fatal(err)
+		}
+		got, err := r.ReadFrameInto(into)
+		if err != nil {
+			b.Fatal(err)
+		}
+		into = got
+	}
+}
+
+// BenchmarkWritePieces shows the per-piece Write calls taken on a Stream
+// that isn't a *net.TCPConn.
+func BenchmarkWritePieces(b *testing.B) {
+	pieces := [][]byte{make([]byte, 16), make([]byte, 1024), make([]byte, 16)}
+	w := NewWriter(io.Discard)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.WritePieces(pieces...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWritePiecesTCP shows WritePieces collapsing the header and all
+// pieces into a single net.Buffers write (one writev syscall) when the
+// underlying Stream is a *net.TCPConn.
+func BenchmarkWritePiecesTCP(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	w := NewWriter(conn.(*net.TCPConn))
+	pieces := [][]byte{make([]byte, 16), make([]byte, 1024), make([]byte, 16)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.WritePieces(pieces...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
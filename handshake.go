@@ -0,0 +1,125 @@
+package framed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Magic identifies this package's handshake protocol. It is a package-level
+// var (rather than a const) so that embedders can fork their own protocol
+// identity by reassigning it before calling Handshake/NewNegotiated.
+var Magic = []byte{'F', 'R', 'M', 'D'}
+
+// Version is a protocol version exchanged during Handshake. The high byte
+// is the major version, the low byte the minor version; peers with
+// differing major versions are considered incompatible, while differing
+// minor versions are just a hint for feature negotiation.
+type Version uint16
+
+// Major returns v's major version component.
+func (v Version) Major() uint8 {
+	return uint8(v >> 8)
+}
+
+// Minor returns v's minor version component.
+func (v Version) Minor() uint8 {
+	return uint8(v)
+}
+
+// ErrBadMagic is returned by Handshake when the peer's first frame doesn't
+// start with Magic.
+type ErrBadMagic struct {
+	Got []byte
+}
+
+func (e *ErrBadMagic) Error() string {
+	return fmt.Sprintf("framed: peer sent magic %x, expected %x", e.Got, Magic)
+}
+
+// ErrVersionMismatch is returned by Handshake when the peer's major version
+// differs from the local one.
+type ErrVersionMismatch struct {
+	Local  Version
+	Remote Version
+}
+
+func (e *ErrVersionMismatch) Error() string {
+	return fmt.Sprintf("framed: incompatible protocol version: local=%d.%d remote=%d.%d",
+		e.Local.Major(), e.Local.Minor(), e.Remote.Major(), e.Remote.Minor())
+}
+
+// Handshake performs the first exchange on rwc: it writes a single frame of
+// [Magic | uint16 local version], reads the peer's counterpart, and returns
+// the peer's negotiated version. It returns ErrBadMagic if the peer's magic
+// doesn't match, or ErrVersionMismatch if the peer's major version is
+// incompatible with local's.
+//
+// The write happens on a separate goroutine from the read, since both sides
+// of a synchronous duplex transport (e.g. net.Pipe) block in Write until the
+// peer calls Read; writing and reading sequentially on both ends would
+// deadlock before either side's ReadFrame could run.
+func Handshake(rwc io.ReadWriteCloser, local Version) (remote Version, err error) {
+	w := NewWriter(rwc)
+	r := NewReader(rwc)
+
+	payload := make([]byte, len(Magic)+2)
+	copy(payload, Magic)
+	binary.BigEndian.PutUint16(payload[len(Magic):], uint16(local))
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := w.Write(payload)
+		writeErr <- err
+	}()
+
+	frame, err := r.ReadFrame()
+	if err != nil {
+		<-writeErr
+		return 0, err
+	}
+	if err = <-writeErr; err != nil {
+		return 0, err
+	}
+
+	gotLen := len(frame)
+	if gotLen > len(Magic) {
+		gotLen = len(Magic)
+	}
+	if len(frame) < len(Magic)+2 || !bytes.Equal(frame[:len(Magic)], Magic) {
+		return 0, &ErrBadMagic{Got: append([]byte(nil), frame[:gotLen]...)}
+	}
+
+	remote = Version(binary.BigEndian.Uint16(frame[len(Magic) : len(Magic)+2]))
+	if remote.Major() != local.Major() {
+		return remote, &ErrVersionMismatch{Local: local, Remote: remote}
+	}
+	return remote, nil
+}
+
+// NegotiatedReadWriteCloser is a ReadWriteCloser whose peer has already been
+// through Handshake, exposing the peer's negotiated Version so higher
+// layers can branch on which features it supports.
+type NegotiatedReadWriteCloser struct {
+	*ReadWriteCloser
+	peerVersion Version
+}
+
+// NewNegotiated performs a Handshake on rwc and, on success, returns a
+// NegotiatedReadWriteCloser for framed reads and writes over rwc.
+func NewNegotiated(rwc io.ReadWriteCloser, local Version) (*NegotiatedReadWriteCloser, error) {
+	remote, err := Handshake(rwc, local)
+	if err != nil {
+		return nil, err
+	}
+	return &NegotiatedReadWriteCloser{
+		ReadWriteCloser: NewReadWriteCloser(rwc),
+		peerVersion:     remote,
+	}, nil
+}
+
+// PeerVersion returns the version the peer negotiated during Handshake.
+func (n *NegotiatedReadWriteCloser) PeerVersion() Version {
+	return n.peerVersion
+}
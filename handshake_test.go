@@ -0,0 +1,81 @@
+package framed
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeSuccess(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	type result struct {
+		remote Version
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		remote, err := Handshake(a, Version(0x0102))
+		resultCh <- result{remote, err}
+	}()
+
+	remote, err := Handshake(b, Version(0x0103))
+	if err != nil {
+		t.Fatalf("Handshake (b): %v", err)
+	}
+	if remote != Version(0x0102) {
+		t.Fatalf("b saw remote version %v, want 0x0102", remote)
+	}
+
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			t.Fatalf("Handshake (a): %v", res.err)
+		}
+		if res.remote != Version(0x0103) {
+			t.Fatalf("a saw remote version %v, want 0x0103", res.remote)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for concurrent Handshake to complete; possible deadlock")
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go Handshake(a, Version(0x0200))
+
+	_, err := Handshake(b, Version(0x0100))
+	verr, ok := err.(*ErrVersionMismatch)
+	if !ok {
+		t.Fatalf("expected *ErrVersionMismatch, got %T: %v", err, err)
+	}
+	if verr.Local != Version(0x0100) || verr.Remote != Version(0x0200) {
+		t.Fatalf("ErrVersionMismatch = %+v, want Local=0x0100 Remote=0x0200", verr)
+	}
+}
+
+func TestHandshakeBadMagic(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		w := NewWriter(a)
+		w.Write([]byte("NOPE"))
+	}()
+	// Handshake(b, ...) still writes its own frame to b, which a must read
+	// to avoid blocking; discard it since this test only cares about b's
+	// reaction to a's bad magic.
+	go io.Copy(io.Discard, a)
+
+	_, err := Handshake(b, Version(0x0100))
+	if _, ok := err.(*ErrBadMagic); !ok {
+		t.Fatalf("expected *ErrBadMagic, got %T: %v", err, err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Package mux layers single-byte stream-type tags on top of framed frames so
+that a single underlying connection can carry several logical streams,
+mirroring what Docker's stdcopy package does for stdout/stderr/systemerr.
+
+Each frame on the wire is an ordinary framed frame (length prefix, payload)
+whose payload is itself [tag | data]. The wire format is therefore a strict
+extension of the framed format: length-prefix then tagged payload.
+*/
+package mux
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/getlantern/framed"
+)
+
+// UnknownTagPolicy controls what a MuxReader does with a frame whose tag has
+// no registered handler in Demux.
+type UnknownTagPolicy int
+
+const (
+	// DropUnknownTag silently discards frames with an unrecognized tag.
+	DropUnknownTag UnknownTagPolicy = iota
+
+	// ErrorUnknownTag causes Demux to return an ErrUnknownTag.
+	ErrorUnknownTag
+
+	// FallbackUnknownTag routes frames with an unrecognized tag to
+	// MuxReader.Fallback. If Fallback is nil, Demux behaves as if
+	// ErrorUnknownTag were set.
+	FallbackUnknownTag
+)
+
+// ErrUnknownTag is returned by Demux when it encounters a tag with no
+// registered handler and UnknownTagPolicy requires erroring.
+type ErrUnknownTag struct {
+	Tag byte
+}
+
+func (e *ErrUnknownTag) Error() string {
+	return fmt.Sprintf("mux: no handler registered for tag %d", e.Tag)
+}
+
+// MuxWriter multiplexes several logical streams, each identified by a tag
+// byte, onto a single underlying io.Writer.
+type MuxWriter struct {
+	writer *framed.Writer
+}
+
+// NewMuxWriter creates a MuxWriter that writes tagged frames to w.
+func NewMuxWriter(w io.Writer) *MuxWriter {
+	return &MuxWriter{writer: framed.NewWriter(w)}
+}
+
+// StreamWriter returns an io.Writer that emits one frame of [tag | payload]
+// per Write call. StreamWriters returned from the same MuxWriter may safely
+// be written to concurrently from multiple goroutines.
+func (mux *MuxWriter) StreamWriter(tag byte) io.Writer {
+	return &streamWriter{mux: mux, tag: tag}
+}
+
+type streamWriter struct {
+	mux *MuxWriter
+	tag byte
+}
+
+func (sw *streamWriter) Write(payload []byte) (n int, err error) {
+	if _, err = sw.mux.writer.WritePieces([]byte{sw.tag}, payload); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+// MuxReader demultiplexes tagged frames read from a single underlying
+// io.Reader.
+type MuxReader struct {
+	reader *framed.Reader
+
+	// UnknownTagPolicy controls how Demux handles frames whose tag has no
+	// registered handler. The zero value is DropUnknownTag.
+	UnknownTagPolicy UnknownTagPolicy
+
+	// Fallback receives frames with an unrecognized tag when
+	// UnknownTagPolicy is FallbackUnknownTag.
+	Fallback io.Writer
+}
+
+// NewMuxReader creates a MuxReader that reads tagged frames from r.
+func NewMuxReader(r io.Reader) *MuxReader {
+	return &MuxReader{reader: framed.NewReader(r)}
+}
+
+// ReadFrame reads the next tagged frame, returning its tag and payload.
+func (mux *MuxReader) ReadFrame() (tag byte, payload []byte, err error) {
+	frame, err := mux.reader.ReadFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(frame) == 0 {
+		return 0, nil, fmt.Errorf("mux: frame missing tag byte")
+	}
+	return frame[0], frame[1:], nil
+}
+
+// Demux reads tagged frames from r in a loop, dispatching each frame's
+// payload to the io.Writer registered for its tag in handlers. It returns
+// when r is exhausted (io.EOF), when a handler write fails, or when an
+// unrecognized tag is encountered under a policy that errors.
+func Demux(r *MuxReader, handlers map[byte]io.Writer) error {
+	for {
+		tag, payload, err := r.ReadFrame()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		w, ok := handlers[tag]
+		if !ok {
+			switch r.UnknownTagPolicy {
+			case ErrorUnknownTag:
+				return &ErrUnknownTag{Tag: tag}
+			case FallbackUnknownTag:
+				w = r.Fallback
+				if w == nil {
+					return &ErrUnknownTag{Tag: tag}
+				}
+			default:
+				continue
+			}
+		}
+
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+type taggedFrame struct {
+	tag     byte
+	payload []byte
+}
+
+func writeTaggedFrames(t *testing.T, frames ...taggedFrame) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewMuxWriter(&buf)
+	for _, f := range frames {
+		if _, err := w.StreamWriter(f.tag).Write(f.payload); err != nil {
+			t.Fatalf("Write tag %d: %v", f.tag, err)
+		}
+	}
+	return &buf
+}
+
+func TestDemuxRoutesKnownTags(t *testing.T) {
+	buf := writeTaggedFrames(t,
+		taggedFrame{1, []byte("out")},
+		taggedFrame{2, []byte("err")},
+	)
+
+	var stdout, stderr bytes.Buffer
+	r := NewMuxReader(buf)
+	handlers := map[byte]io.Writer{1: &stdout, 2: &stderr}
+	if err := Demux(r, handlers); err != nil {
+		t.Fatalf("Demux: %v", err)
+	}
+	if stdout.String() != "out" {
+		t.Fatalf("stdout = %q, want out", stdout.String())
+	}
+	if stderr.String() != "err" {
+		t.Fatalf("stderr = %q, want err", stderr.String())
+	}
+}
+
+func TestDemuxDropsUnknownTagByDefault(t *testing.T) {
+	buf := writeTaggedFrames(t,
+		taggedFrame{9, []byte("ignored")},
+		taggedFrame{1, []byte("kept")},
+	)
+
+	var out bytes.Buffer
+	r := NewMuxReader(buf)
+	if err := Demux(r, map[byte]io.Writer{1: &out}); err != nil {
+		t.Fatalf("Demux: %v", err)
+	}
+	if out.String() != "kept" {
+		t.Fatalf("out = %q, want kept", out.String())
+	}
+}
+
+func TestDemuxErrorsOnUnknownTagWhenPolicySet(t *testing.T) {
+	buf := writeTaggedFrames(t, taggedFrame{9, []byte("ignored")})
+
+	r := NewMuxReader(buf)
+	r.UnknownTagPolicy = ErrorUnknownTag
+	err := Demux(r, nil)
+	var unknown *ErrUnknownTag
+	if !errors.As(err, &unknown) {
+		t.Fatalf("Demux = %v, want *ErrUnknownTag", err)
+	}
+	if unknown.Tag != 9 {
+		t.Fatalf("ErrUnknownTag.Tag = %d, want 9", unknown.Tag)
+	}
+}
+
+func TestDemuxFallsBackOnUnknownTagWhenPolicySet(t *testing.T) {
+	buf := writeTaggedFrames(t, taggedFrame{9, []byte("fallback me")})
+
+	var fallback bytes.Buffer
+	r := NewMuxReader(buf)
+	r.UnknownTagPolicy = FallbackUnknownTag
+	r.Fallback = &fallback
+	if err := Demux(r, nil); err != nil {
+		t.Fatalf("Demux: %v", err)
+	}
+	if fallback.String() != "fallback me" {
+		t.Fatalf("fallback = %q, want fallback me", fallback.String())
+	}
+}
+
+func TestDemuxFallbackUnknownTagWithoutFallbackErrors(t *testing.T) {
+	buf := writeTaggedFrames(t, taggedFrame{9, []byte("x")})
+
+	r := NewMuxReader(buf)
+	r.UnknownTagPolicy = FallbackUnknownTag
+	err := Demux(r, nil)
+	var unknown *ErrUnknownTag
+	if !errors.As(err, &unknown) {
+		t.Fatalf("Demux = %v, want *ErrUnknownTag", err)
+	}
+}
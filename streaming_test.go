@@ -0,0 +1,271 @@
+package framed
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func writeTwoFrames(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if _, err := w.Write([]byte("AAAA")); err != nil {
+		t.Fatalf("Write first frame: %v", err)
+	}
+	if _, err := w.Write([]byte("BBBBBBBB")); err != nil {
+		t.Fatalf("Write second frame: %v", err)
+	}
+	return &buf
+}
+
+func TestNextFrameThenReadStreamsPayload(t *testing.T) {
+	buf := writeTwoFrames(t)
+	r := NewReader(buf)
+
+	l, err := r.NextFrame()
+	if err != nil {
+		t.Fatalf("NextFrame: %v", err)
+	}
+	if l != 4 {
+		t.Fatalf("NextFrame length = %d, want 4", l)
+	}
+
+	got := make([]byte, 4)
+	n, err := r.Read(got)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if n != 4 || string(got) != "AAAA" {
+		t.Fatalf("Read = %q, want AAAA", got[:n])
+	}
+
+	// Once the declared frame is fully drained, Read reports io.EOF.
+	if _, err := r.Read(got); err != io.EOF {
+		t.Fatalf("Read at end of frame = %v, want io.EOF", err)
+	}
+
+	// streamingMode is sticky once NextFrame has been called: after the
+	// frame's io.EOF, Read refuses rather than falling back to the legacy
+	// whole-frame behavior.
+	if _, err := r.Read(got); err != ErrNoFrameAdvance {
+		t.Fatalf("Read after drain = %v, want ErrNoFrameAdvance", err)
+	}
+}
+
+func TestReadFrameAfterNextFrameWithoutDraining(t *testing.T) {
+	buf := writeTwoFrames(t)
+	r := NewReader(buf)
+
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatalf("NextFrame: %v", err)
+	}
+
+	// Without AutoDiscard, ReadFrame must refuse rather than misreading the
+	// still-pending frame's payload as a new header.
+	if _, err := r.ReadFrame(); err == nil {
+		t.Fatal("expected ReadFrame to reject a pending undrained frame, got nil error")
+	}
+}
+
+func TestReadFrameAfterNextFrameWithAutoDiscard(t *testing.T) {
+	buf := writeTwoFrames(t)
+	r := NewReader(buf)
+	r.AutoDiscard = true
+
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatalf("NextFrame: %v", err)
+	}
+
+	// With AutoDiscard, ReadFrame should discard the remaining "AAAA" bytes
+	// and correctly return the second frame.
+	frame, err := r.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if string(frame) != "BBBBBBBB" {
+		t.Fatalf("ReadFrame = %q, want BBBBBBBB", frame)
+	}
+}
+
+func TestNextFrameAutoDiscardsPreviousFrame(t *testing.T) {
+	buf := writeTwoFrames(t)
+	r := NewReader(buf)
+	r.AutoDiscard = true
+
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatalf("first NextFrame: %v", err)
+	}
+
+	l, err := r.NextFrame()
+	if err != nil {
+		t.Fatalf("second NextFrame: %v", err)
+	}
+	if l != 8 {
+		t.Fatalf("second NextFrame length = %d, want 8", l)
+	}
+
+	got := make([]byte, 8)
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(got) != "BBBBBBBB" {
+		t.Fatalf("Read = %q, want BBBBBBBB", got)
+	}
+}
+
+func TestReadAfterNextFrameWithoutAdvanceErrors(t *testing.T) {
+	buf := writeTwoFrames(t)
+	r := NewReader(buf)
+
+	l, err := r.NextFrame()
+	if err != nil {
+		t.Fatalf("NextFrame: %v", err)
+	}
+	got := make([]byte, l)
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// The frame declared by NextFrame is now fully drained, so the next Read
+	// reports io.EOF. Calling Read again without a fresh NextFrame must fail
+	// rather than silently resuming legacy whole-frame reads.
+	if _, err := r.Read(got); err != io.EOF {
+		t.Fatalf("Read at end of frame = %v, want io.EOF", err)
+	}
+	if _, err := r.Read(got); err != ErrNoFrameAdvance {
+		t.Fatalf("Read without NextFrame = %v, want ErrNoFrameAdvance", err)
+	}
+}
+
+func TestReadFrameRejectsOverflowingVarintHeader(t *testing.T) {
+	// Nine 0x80 continuation bytes followed by 0x01 decodes, one byte at a
+	// time per readUvarint, to a uint64 with bit 63 set: s reaches 63 on the
+	// 10th byte, so b[0]<<s shifts the low bit into the sign bit. int(nb)
+	// would then be negative on 64-bit platforms, reaching make([]byte, l)
+	// as a slice length instead of being rejected as too large.
+	header := append(bytes.Repeat([]byte{0x80}, 9), 0x01)
+	r := NewReaderWithFormat(bytes.NewReader(header), HeaderVarint)
+
+	_, err := r.ReadFrame()
+	if err != ErrMalformedHeader {
+		t.Fatalf("ReadFrame = %v, want ErrMalformedHeader", err)
+	}
+}
+
+func TestDefaultMaxFrameLengthIsConservativeForAllFormats(t *testing.T) {
+	// A header format that can encode frames far larger than MaxFrameLength
+	// must still reject them by default, so a single small header can't
+	// commit a peer to an unbounded allocation without MaxFrameLength
+	// having been set explicitly.
+	for _, format := range []HeaderFormat{HeaderUint32BE, HeaderVarint} {
+		var buf bytes.Buffer
+		w := NewWriterWithFormat(&buf, format)
+		w.MaxFrameLength = 1 << 20 // opt in on the write side only
+		oversized := bytes.Repeat([]byte{'x'}, MaxFrameLength+1)
+		if _, err := w.Write(oversized); err != nil {
+			t.Fatalf("format %d: Write: %v", format, err)
+		}
+
+		r := NewReaderWithFormat(&buf, format)
+		_, err := r.ReadFrame()
+		if _, ok := err.(*ErrFrameTooLarge); !ok {
+			t.Fatalf("format %d: ReadFrame = %v, want *ErrFrameTooLarge", format, err)
+		}
+	}
+}
+
+func TestErrFrameTooLargeWordingDiffersForReadsAndWrites(t *testing.T) {
+	w := NewWriter(io.Discard)
+	w.MaxFrameLength = 4
+	_, err := w.Write([]byte("toolong"))
+	werr, ok := err.(*ErrFrameTooLarge)
+	if !ok {
+		t.Fatalf("Write: expected *ErrFrameTooLarge, got %T: %v", err, err)
+	}
+	if werr.Reading {
+		t.Fatal("write-side ErrFrameTooLarge has Reading=true")
+	}
+
+	var buf bytes.Buffer
+	wOK := NewWriter(&buf)
+	if _, err := wOK.Write([]byte("toolong")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	r := NewReader(&buf)
+	r.MaxFrameLength = 4
+	_, err = r.ReadFrame()
+	rerr, ok := err.(*ErrFrameTooLarge)
+	if !ok {
+		t.Fatalf("ReadFrame: expected *ErrFrameTooLarge, got %T: %v", err, err)
+	}
+	if !rerr.Reading {
+		t.Fatal("read-side ErrFrameTooLarge has Reading=false")
+	}
+
+	if werr.Error() == rerr.Error() {
+		t.Fatalf("expected distinct wording for read vs write errors, both got %q", werr.Error())
+	}
+}
+
+func TestReadFrameIntoAfterNextFrameWithoutDraining(t *testing.T) {
+	buf := writeTwoFrames(t)
+	r := NewReader(buf)
+
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatalf("NextFrame: %v", err)
+	}
+
+	if _, err := r.ReadFrameInto(nil); err == nil {
+		t.Fatal("expected ReadFrameInto to reject a pending undrained frame, got nil error")
+	}
+}
+
+func TestReadFrameIntoAfterNextFrameWithAutoDiscard(t *testing.T) {
+	buf := writeTwoFrames(t)
+	r := NewReader(buf)
+	r.AutoDiscard = true
+
+	if _, err := r.NextFrame(); err != nil {
+		t.Fatalf("NextFrame: %v", err)
+	}
+
+	frame, err := r.ReadFrameInto(nil)
+	if err != nil {
+		t.Fatalf("ReadFrameInto: %v", err)
+	}
+	if string(frame) != "BBBBBBBB" {
+		t.Fatalf("ReadFrameInto = %q, want BBBBBBBB", frame)
+	}
+}
+
+func TestHeaderFormatRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 254, 255, 256, 65535, 70000}
+	formats := []HeaderFormat{HeaderUint16LE, HeaderUint32BE, HeaderVarint}
+
+	for _, format := range formats {
+		for _, size := range sizes {
+			if format == HeaderUint16LE && size > MaxFrameLength {
+				continue
+			}
+
+			var buf bytes.Buffer
+			w := NewWriterWithFormat(&buf, format)
+			w.MaxFrameLength = 1 << 20
+			r := NewReaderWithFormat(&buf, format)
+			r.MaxFrameLength = 1 << 20
+
+			payload := bytes.Repeat([]byte{'x'}, size)
+			if _, err := w.Write(payload); err != nil {
+				t.Fatalf("format %d size %d: Write: %v", format, size, err)
+			}
+			got, err := r.ReadFrame()
+			if err != nil {
+				t.Fatalf("format %d size %d: ReadFrame: %v", format, size, err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("format %d size %d: got %d bytes, want %d bytes", format, size, len(got), len(payload))
+			}
+		}
+	}
+}